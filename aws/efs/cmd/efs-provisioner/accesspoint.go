@@ -0,0 +1,240 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/efs"
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/controller"
+	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/gidallocator"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	provisioningModeKey         = "provisioningMode"
+	provisioningModeSubdir      = "subdir"
+	provisioningModeAccessPoint = "accesspoint"
+
+	accessPointIDAnnotation = "efs.provisioner/access-point-id"
+)
+
+// provisioningModeOption determines whether a PVC should be provisioned as a
+// subdirectory of the shared mount (the default) or as its own EFS access point.
+func provisioningModeOption(options controller.VolumeOptions) (string, error) {
+	mode, ok := options.Parameters[provisioningModeKey]
+	if !ok || mode == "" {
+		return provisioningModeSubdir, nil
+	}
+
+	switch mode {
+	case provisioningModeSubdir, provisioningModeAccessPoint:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid value %s for parameter %s", mode, provisioningModeKey)
+	}
+}
+
+// posixUserOption derives the uid/gid to own the access point's root directory,
+// preferring explicit StorageClass parameters over the GID allocator.
+func posixUserOption(options controller.VolumeOptions, gid *int) (*efs.PosixUser, error) {
+	var uid int64
+	if uidStr, ok := options.Parameters["uid"]; ok {
+		parsed, err := strconv.ParseInt(uidStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %s for parameter uid: %v", uidStr, err)
+		}
+		uid = parsed
+	}
+
+	var posixGid int64
+	switch {
+	case options.Parameters["gid"] != "":
+		parsed, err := strconv.ParseInt(options.Parameters["gid"], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %s for parameter gid: %v", options.Parameters["gid"], err)
+		}
+		posixGid = parsed
+	case gid != nil:
+		posixGid = int64(*gid)
+	default:
+		return nil, fmt.Errorf("accesspoint provisioning mode requires either a gid storage class parameter or gidAllocate")
+	}
+
+	return &efs.PosixUser{
+		Uid: aws.Int64(uid),
+		Gid: aws.Int64(posixGid),
+	}, nil
+}
+
+// directoryPermsOption parses the directoryPerms StorageClass parameter, defaulting to 0777.
+func directoryPermsOption(options controller.VolumeOptions) (os.FileMode, error) {
+	permsStr, ok := options.Parameters["directoryPerms"]
+	if !ok || permsStr == "" {
+		return os.FileMode(0777), nil
+	}
+
+	perms, err := strconv.ParseUint(permsStr, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %s for parameter directoryPerms: %v", permsStr, err)
+	}
+
+	return os.FileMode(perms), nil
+}
+
+// provisionAccessPoint provisions a PV backed by a dedicated EFS access point rather
+// than a subdirectory of the shared mount. The provisioner never touches the
+// directory itself here, so it doesn't need the EFS root mounted to serve this
+// StorageClass, and pods mount only their own access point subtree.
+func (p *efsProvisioner) provisionAccessPoint(fileSystemID, region, dnsName string, svc *efs.EFS, options controller.VolumeOptions) (*v1.PersistentVolume, error) {
+	dirname, err := p.getDirectoryName(options)
+	if err != nil {
+		return nil, err
+	}
+	remotePath := path.Join("/", dirname)
+
+	var gid *int
+	gidAllocate, err := gidAllocateOption(options)
+	if err != nil {
+		return nil, err
+	}
+	if gidAllocate && options.Parameters["gid"] == "" {
+		allocate, err := p.allocator.AllocateNext(options)
+		if err != nil {
+			return nil, err
+		}
+		gid = &allocate
+	}
+
+	posixUser, err := posixUserOption(options, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	perms, err := directoryPermsOption(options)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &efs.CreateAccessPointInput{
+		FileSystemId: aws.String(fileSystemID),
+		PosixUser:    posixUser,
+		RootDirectory: &efs.RootDirectory{
+			Path: aws.String(remotePath),
+			CreationInfo: &efs.CreationInfo{
+				OwnerUid:    posixUser.Uid,
+				OwnerGid:    posixUser.Gid,
+				Permissions: aws.String(strconv.FormatUint(uint64(perms.Perm()), 8)),
+			},
+		},
+		Tags: []*efs.Tag{
+			{Key: aws.String("kubernetes.io/pvc-name"), Value: aws.String(options.PVC.Name)},
+			{Key: aws.String("kubernetes.io/pvc-namespace"), Value: aws.String(options.PVC.Namespace)},
+		},
+	}
+
+	ap, err := svc.CreateAccessPoint(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create access point for %s/%s: %v", options.PVC.Namespace, options.PVC.Name, err)
+	}
+
+	glog.Infof("created access point %s for %s/%s", aws.StringValue(ap.AccessPointId), options.PVC.Namespace, options.PVC.Name)
+
+	mountOptions := accessPointMountOptions(options.MountOptions, aws.StringValue(ap.AccessPointId))
+
+	annotations := map[string]string{
+		accessPointIDAnnotation: aws.StringValue(ap.AccessPointId),
+		fileSystemIDAnnotation:  fileSystemID,
+		awsRegionAnnotation:     region,
+	}
+	if gid != nil {
+		annotations[gidallocator.VolumeGidAnnotationKey] = strconv.FormatInt(int64(*gid), 10)
+	}
+	if secretName := options.Parameters[awsCredentialsSecretNameParam]; secretName != "" {
+		annotations[awsCredentialsSecretNameAnnotation] = secretName
+		annotations[awsCredentialsSecretNamespaceAnnotation] = options.Parameters[awsCredentialsSecretNamespaceParam]
+	}
+
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        options.PVName,
+			Annotations: annotations,
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: options.PersistentVolumeReclaimPolicy,
+			AccessModes:                   options.PVC.Spec.AccessModes,
+			Capacity: v1.ResourceList{
+				v1.ResourceName(v1.ResourceStorage): options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
+			},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				NFS: &v1.NFSVolumeSource{
+					Server:   dnsName,
+					Path:     "/",
+					ReadOnly: false,
+				},
+			},
+			MountOptions: mountOptions,
+		},
+	}
+
+	return pv, nil
+}
+
+// accessPointMountOptions builds the mount options for an access point PV,
+// appending the accesspoint option to the StorageClass's own mountOptions if
+// it set any, and otherwise defaulting to just vers=4.1. EFS access-point
+// mounts require vers=4.1, so it's added whenever a custom mountOptions list
+// doesn't already include it, rather than only in the default case.
+func accessPointMountOptions(mountOptions []string, accessPointID string) []string {
+	hasVersion := false
+	for _, opt := range mountOptions {
+		if opt == "vers=4.1" {
+			hasVersion = true
+			break
+		}
+	}
+
+	result := make([]string, 0, len(mountOptions)+2)
+	if !hasVersion {
+		result = append(result, "vers=4.1")
+	}
+	result = append(result, mountOptions...)
+	result = append(result, "accesspoint="+accessPointID)
+
+	return result
+}
+
+// deleteAccessPoint deletes the EFS access point identified by accessPointID,
+// set in accessPointIDAnnotation by provisionAccessPoint.
+func deleteAccessPoint(svc *efs.EFS, accessPointID string) error {
+	_, err := svc.DeleteAccessPoint(&efs.DeleteAccessPointInput{
+		AccessPointId: aws.String(accessPointID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete access point %s: %v", accessPointID, err)
+	}
+
+	glog.Infof("deleted access point %s", accessPointID)
+
+	return nil
+}
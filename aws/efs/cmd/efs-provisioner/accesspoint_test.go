@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/controller"
+)
+
+func TestPosixUserOption(t *testing.T) {
+	gid := 2000
+
+	cases := []struct {
+		name       string
+		parameters map[string]string
+		gid        *int
+		wantUID    int64
+		wantGID    int64
+		wantErr    bool
+	}{
+		{
+			name:       "gid parameter takes precedence over allocated gid",
+			parameters: map[string]string{"uid": "1000", "gid": "3000"},
+			gid:        &gid,
+			wantUID:    1000,
+			wantGID:    3000,
+		},
+		{
+			name:       "falls back to allocated gid",
+			parameters: map[string]string{"uid": "1000"},
+			gid:        &gid,
+			wantUID:    1000,
+			wantGID:    2000,
+		},
+		{
+			name:       "defaults uid to 0",
+			parameters: map[string]string{"gid": "3000"},
+			wantGID:    3000,
+		},
+		{
+			name:       "no gid parameter and no allocated gid is an error",
+			parameters: map[string]string{"uid": "1000"},
+			wantErr:    true,
+		},
+		{
+			name:       "invalid uid is an error",
+			parameters: map[string]string{"uid": "not-a-number", "gid": "3000"},
+			wantErr:    true,
+		},
+		{
+			name:       "invalid gid is an error",
+			parameters: map[string]string{"gid": "not-a-number"},
+			wantErr:    true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			options := controller.VolumeOptions{Parameters: c.parameters}
+
+			posixUser, err := posixUserOption(options, c.gid)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if aws.Int64Value(posixUser.Uid) != c.wantUID {
+				t.Errorf("uid = %d, want %d", aws.Int64Value(posixUser.Uid), c.wantUID)
+			}
+			if aws.Int64Value(posixUser.Gid) != c.wantGID {
+				t.Errorf("gid = %d, want %d", aws.Int64Value(posixUser.Gid), c.wantGID)
+			}
+		})
+	}
+}
+
+func TestDirectoryPermsOption(t *testing.T) {
+	cases := []struct {
+		name       string
+		parameters map[string]string
+		want       os.FileMode
+		wantErr    bool
+	}{
+		{
+			name:       "defaults to 0777",
+			parameters: map[string]string{},
+			want:       os.FileMode(0777),
+		},
+		{
+			name:       "parses an explicit octal value",
+			parameters: map[string]string{"directoryPerms": "0750"},
+			want:       os.FileMode(0750),
+		},
+		{
+			name:       "invalid value is an error",
+			parameters: map[string]string{"directoryPerms": "not-octal"},
+			wantErr:    true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			perms, err := directoryPermsOption(controller.VolumeOptions{Parameters: c.parameters})
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if perms != c.want {
+				t.Errorf("directoryPermsOption() = %o, want %o", perms, c.want)
+			}
+		})
+	}
+}
+
+func TestAccessPointMountOptions(t *testing.T) {
+	cases := []struct {
+		name         string
+		mountOptions []string
+		want         []string
+	}{
+		{
+			name:         "nil mountOptions defaults to vers=4.1",
+			mountOptions: nil,
+			want:         []string{"vers=4.1", "accesspoint=fsap-1"},
+		},
+		{
+			name:         "custom mountOptions without vers still get it added",
+			mountOptions: []string{"nolock"},
+			want:         []string{"vers=4.1", "nolock", "accesspoint=fsap-1"},
+		},
+		{
+			name:         "custom mountOptions already specifying vers aren't duplicated",
+			mountOptions: []string{"vers=4.1", "nolock"},
+			want:         []string{"vers=4.1", "nolock", "accesspoint=fsap-1"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := accessPointMountOptions(c.mountOptions, "fsap-1")
+
+			if len(got) != len(c.want) {
+				t.Fatalf("accessPointMountOptions() = %v, want %v", got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Errorf("accessPointMountOptions()[%d] = %q, want %q", i, got[i], c.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/efs"
+	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/controller"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	awsCredentialsSecretNameParam      = "awsCredentialsSecretName"
+	awsCredentialsSecretNamespaceParam = "awsCredentialsSecretNamespace"
+
+	// awsCredentialsSecretNameAnnotation and awsCredentialsSecretNamespaceAnnotation
+	// record which Secret an access point PV's credentials came from, so Delete can
+	// reconstruct the same credentials without needing the StorageClass.
+	awsCredentialsSecretNameAnnotation      = "efs.provisioner/aws-credentials-secret-name"
+	awsCredentialsSecretNamespaceAnnotation = "efs.provisioner/aws-credentials-secret-namespace"
+
+	defaultCredentialsSecretNamespace = "default"
+)
+
+// cachedCredentials pairs resolved credentials with the ResourceVersion of the
+// Secret they were built from, so they're rebuilt whenever the secret changes.
+type cachedCredentials struct {
+	resourceVersion string
+	credentials     *credentials.Credentials
+}
+
+// credentialsOption resolves the awsCredentialsSecretName/awsCredentialsSecretNamespace
+// StorageClass parameters to credentials for the given region, returning nil, nil if
+// awsCredentialsSecretName isn't set (whether or not a namespace is), meaning the
+// caller should fall back to the SDK's default credential chain.
+func (p *efsProvisioner) credentialsOption(options controller.VolumeOptions, region string) (*credentials.Credentials, error) {
+	return p.credentialsForSecret(
+		options.Parameters[awsCredentialsSecretNameParam],
+		options.Parameters[awsCredentialsSecretNamespaceParam],
+		region,
+	)
+}
+
+// credentialsForSecret fetches secretName/secretNamespace and builds credentials
+// from its access_key_id/secret_access_key/session_token keys, assuming role_arn
+// via STS if set. Credentials are cached by the secret's ResourceVersion, so
+// rotating the secret's keys is picked up without restarting the provisioner.
+func (p *efsProvisioner) credentialsForSecret(secretName, secretNamespace, region string) (*credentials.Credentials, error) {
+	if secretName == "" {
+		return nil, nil
+	}
+	if secretNamespace == "" {
+		secretNamespace = defaultCredentialsSecretNamespace
+	}
+
+	secret, err := p.client.CoreV1().Secrets(secretNamespace).Get(secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch credentials secret %s/%s: %v", secretNamespace, secretName, err)
+	}
+
+	cacheKey := secretNamespace + "/" + secretName
+
+	p.credentialsMutex.Lock()
+	defer p.credentialsMutex.Unlock()
+
+	if cached, ok := p.credentialsCache[cacheKey]; ok && cached.resourceVersion == secret.ResourceVersion {
+		return cached.credentials, nil
+	}
+
+	creds := credentials.NewStaticCredentials(
+		string(secret.Data["access_key_id"]),
+		string(secret.Data["secret_access_key"]),
+		string(secret.Data["session_token"]),
+	)
+
+	if roleArn := string(secret.Data["role_arn"]); roleArn != "" {
+		sess, err := session.NewSession(&aws.Config{Region: aws.String(region), Credentials: creds})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create session to assume role %s: %v", roleArn, err)
+		}
+		creds = stscreds.NewCredentials(sess, roleArn)
+	}
+
+	p.credentialsCache[cacheKey] = cachedCredentials{resourceVersion: secret.ResourceVersion, credentials: creds}
+
+	return creds, nil
+}
+
+// efsClient builds an AWS EFS client for region, using creds if given or the
+// SDK's default credential chain otherwise.
+func efsClient(region string, creds *credentials.Credentials) (*efs.EFS, error) {
+	config := &aws.Config{Region: aws.String(region)}
+	if creds != nil {
+		config.Credentials = creds
+	}
+
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create an AWS session for region %s: %v", region, err)
+	}
+
+	return efs.New(sess, config), nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestProvisionerWithSecret(secret *v1.Secret) *efsProvisioner {
+	var clientset *fake.Clientset
+	if secret == nil {
+		clientset = fake.NewSimpleClientset()
+	} else {
+		clientset = fake.NewSimpleClientset(secret)
+	}
+
+	return &efsProvisioner{
+		client:           clientset,
+		credentialsCache: make(map[string]cachedCredentials),
+	}
+}
+
+func TestCredentialsForSecretNoSecretName(t *testing.T) {
+	p := newTestProvisionerWithSecret(nil)
+
+	creds, err := p.credentialsForSecret("", "", "us-east-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if creds != nil {
+		t.Fatalf("expected nil credentials when no secret is configured, got %v", creds)
+	}
+}
+
+func TestCredentialsForSecretCachesByResourceVersion(t *testing.T) {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "aws-creds", Namespace: "kube-system", ResourceVersion: "1"},
+		Data: map[string][]byte{
+			"access_key_id":     []byte("AKIAEXAMPLE"),
+			"secret_access_key": []byte("secretkey"),
+		},
+	}
+	p := newTestProvisionerWithSecret(secret)
+
+	first, err := p.credentialsForSecret("aws-creds", "kube-system", "us-east-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	second, err := p.credentialsForSecret("aws-creds", "kube-system", "us-east-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if first != second {
+		t.Errorf("expected the cached credentials to be reused when ResourceVersion is unchanged")
+	}
+}
+
+func TestCredentialsForSecretInvalidatesOnResourceVersionChange(t *testing.T) {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "aws-creds", Namespace: "kube-system", ResourceVersion: "1"},
+		Data: map[string][]byte{
+			"access_key_id":     []byte("AKIAEXAMPLE"),
+			"secret_access_key": []byte("secretkey"),
+		},
+	}
+	p := newTestProvisionerWithSecret(secret)
+
+	first, err := p.credentialsForSecret("aws-creds", "kube-system", "us-east-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updated := secret.DeepCopy()
+	updated.ResourceVersion = "2"
+	updated.Data["secret_access_key"] = []byte("rotated-secretkey")
+	if _, err := p.client.CoreV1().Secrets("kube-system").Update(updated); err != nil {
+		t.Fatalf("failed to update secret: %v", err)
+	}
+
+	second, err := p.credentialsForSecret("aws-creds", "kube-system", "us-east-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if first == second {
+		t.Errorf("expected credentials to be rebuilt after the secret's ResourceVersion changed")
+	}
+
+	cached, ok := p.credentialsCache["kube-system/aws-creds"]
+	if !ok {
+		t.Fatalf("expected the cache to hold an entry for kube-system/aws-creds")
+	}
+	if cached.resourceVersion != "2" {
+		t.Errorf("cached resourceVersion = %q, want %q", cached.resourceVersion, "2")
+	}
+}
+
+func TestCredentialsForSecretDefaultsNamespace(t *testing.T) {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "aws-creds", Namespace: defaultCredentialsSecretNamespace, ResourceVersion: "1"},
+		Data: map[string][]byte{
+			"access_key_id":     []byte("AKIAEXAMPLE"),
+			"secret_access_key": []byte("secretkey"),
+		},
+	}
+	p := newTestProvisionerWithSecret(secret)
+
+	if _, err := p.credentialsForSecret("aws-creds", "", "us-east-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := p.credentialsCache[defaultCredentialsSecretNamespace+"/aws-creds"]; !ok {
+		t.Errorf("expected credentials to be cached under the default namespace")
+	}
+}
+
+func TestCredentialsForSecretMissingSecret(t *testing.T) {
+	p := newTestProvisionerWithSecret(nil)
+
+	if _, err := p.credentialsForSecret("missing", "kube-system", "us-east-1"); err == nil {
+		t.Fatalf("expected an error when the secret doesn't exist, got none")
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -37,8 +38,11 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/kubernetes/pkg/apis/core/v1/helper"
 )
 
@@ -51,11 +55,31 @@ const (
 
 var _ controller.Provisioner = &efsProvisioner{}
 
+// efsProvisioner can serve PVCs backed by more than one EFS filesystem: the one
+// it was started against (defaultFileSystemID/defaultRegion, from FILE_SYSTEM_ID/
+// AWS_REGION) plus any number of others selected per StorageClass via the
+// fileSystemId/awsRegion/dnsName parameters. filesystems holds the local mount
+// point for every filesystem getFilesystem has handed out so far; filesystems
+// used only in accesspoint mode are never mounted and don't appear in it.
 type efsProvisioner struct {
-	allocator  gidallocator.Allocator
-	dnsName    string
-	mountpoint string
-	source     string
+	client        kubernetes.Interface
+	allocator     gidallocator.Allocator
+	metrics       *metricsCollector
+	quotaEnforcer *quotaEnforcer
+
+	root                string
+	defaultFileSystemID string
+	defaultRegion       string
+
+	mutex       sync.Mutex
+	filesystems map[string]*mountedFilesystem
+
+	// credentialsMutex and credentialsCache guard the credentials resolved from
+	// awsCredentialsSecretName/awsCredentialsSecretNamespace, keyed by the secret's
+	// namespace/name and rebuilt whenever its ResourceVersion changes, so a secret's
+	// keys can be rotated without restarting the provisioner.
+	credentialsMutex sync.Mutex
+	credentialsCache map[string]cachedCredentials
 }
 
 // NewEFSProvisioner creates an AWS EFS volume provisioner
@@ -96,14 +120,62 @@ func NewEFSProvisioner(client kubernetes.Interface) controller.Provisioner {
 		glog.Warningf("couldn't confirm that the EFS file system exists: %v", err)
 	}
 
-	allocator := gidallocator.NewWithGIDReclaimer(client, newFileSystemReclaimer(mountpoint))
+	root := os.Getenv(provisionerRootKey)
+	if root == "" {
+		root = defaultProvisionerRoot
+	}
+
+	// p is assigned below, once constructed; resolveBasePath is only invoked lazily
+	// by the GID allocator, by which point p is guaranteed to be set.
+	var p *efsProvisioner
+	resolveBasePath := func(classname string) (string, error) {
+		sc, err := client.StorageV1().StorageClasses().Get(classname, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+
+		scFileSystemID, scRegion, scDNSName := p.filesystemOptions(controller.VolumeOptions{Parameters: sc.Parameters})
+
+		fs, err := p.getFilesystem(scFileSystemID, scRegion, scDNSName)
+		if err != nil {
+			return "", err
+		}
 
-	return &efsProvisioner{
-		dnsName:    dnsName,
-		mountpoint: mountpoint,
-		source:     source,
-		allocator:  allocator,
+		return fs.mountpoint, nil
 	}
+
+	allocator := gidallocator.NewWithGIDReclaimer(client, newFileSystemReclaimer(mountpoint, client, resolveBasePath))
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "efs-provisioner"})
+
+	quotaEnforcer := newQuotaEnforcer(client, recorder)
+	go wait.Forever(quotaEnforcer.checkAll, quotaCheckInterval)
+
+	p = &efsProvisioner{
+		client:        client,
+		allocator:     allocator,
+		metrics:       newMetricsCollector(metricsCacheTTL()),
+		quotaEnforcer: quotaEnforcer,
+
+		root:                root,
+		defaultFileSystemID: fileSystemID,
+		defaultRegion:       awsRegion,
+		filesystems: map[string]*mountedFilesystem{
+			filesystemKey(fileSystemID, awsRegion): {
+				fileSystemID: fileSystemID,
+				region:       awsRegion,
+				dnsName:      dnsName,
+				mountpoint:   mountpoint,
+				source:       source,
+				projectIDs:   newProjectIDAllocator(),
+			},
+		},
+		credentialsCache: make(map[string]cachedCredentials),
+	}
+
+	return p
 }
 
 func getDNSName(fileSystemID, awsRegion string) string {
@@ -128,6 +200,27 @@ func getMount(dnsName string) (string, string, error) {
 	return "", "", fmt.Errorf("no mount entry found for %s among entries %s", dnsName, entriesStr)
 }
 
+// gidAllocateOption determines whether a GID should be allocated for the volume,
+// defaulting to true, per the gidAllocate StorageClass parameter.
+func gidAllocateOption(options controller.VolumeOptions) (bool, error) {
+	gidAllocate := true
+	for k, v := range options.Parameters {
+		switch strings.ToLower(k) {
+		case "gidmin":
+			// Let allocator handle
+		case "gidmax":
+			// Let allocator handle
+		case "gidallocate":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return false, fmt.Errorf("invalid value %s for parameter %s: %v", v, k, err)
+			}
+			gidAllocate = b
+		}
+	}
+	return gidAllocate, nil
+}
+
 func reuseVolumesOption(options controller.VolumeOptions) (bool, error) {
 	if reuseStr, ok := options.Parameters["reuseVolumes"]; ok {
 		reuse, err := strconv.ParseBool(options.Parameters["reuseVolumes"])
@@ -145,7 +238,39 @@ func (p *efsProvisioner) Provision(options controller.VolumeOptions) (*v1.Persis
 		return nil, fmt.Errorf("claim.Spec.Selector is not supported")
 	}
 
-	volumePath, err := p.getLocalPath(options)
+	mode, err := provisioningModeOption(options)
+	if err != nil {
+		glog.Errorf("%v", err)
+		return nil, err
+	}
+
+	fileSystemID, region, dnsName := p.filesystemOptions(options)
+
+	if mode == provisioningModeAccessPoint {
+		if dnsName == "" {
+			dnsName = getDNSName(fileSystemID, region)
+		}
+
+		creds, err := p.credentialsOption(options, region)
+		if err != nil {
+			return nil, err
+		}
+
+		svc, err := efsClient(region, creds)
+		if err != nil {
+			return nil, err
+		}
+
+		return p.provisionAccessPoint(fileSystemID, region, dnsName, svc, options)
+	}
+
+	fs, err := p.getFilesystem(fileSystemID, region, dnsName)
+	if err != nil {
+		glog.Errorf("Failed to resolve filesystem: %v", err)
+		return nil, err
+	}
+
+	volumePath, err := p.getLocalPath(fs, options)
 	if err != nil {
 		glog.Errorf("Failed to provision volume: %v", err)
 		return nil, err
@@ -157,12 +282,19 @@ func (p *efsProvisioner) Provision(options controller.VolumeOptions) (*v1.Persis
 	var existingGid uint32
 	var gid *int
 	var reuseVolumes bool
+	var md *volumeMetadata
 
 	if reuseVolumes, err = reuseVolumesOption(options); err != nil {
 		glog.Errorf("%v", err)
 		return nil, err
 	}
 
+	enforceQuota, err := enforceQuotaOption(options)
+	if err != nil {
+		glog.Errorf("%v", err)
+		return nil, err
+	}
+
 	if reuseVolumes {
 		volExists, existingGid, err = volumeExists(volumePath) // existingGid is the actual gid on the directory in the file system
 		if err != nil {
@@ -174,7 +306,7 @@ func (p *efsProvisioner) Provision(options controller.VolumeOptions) (*v1.Persis
 	if volExists {
 		glog.Infof("%s already exists", volumePath)
 
-		md, err := readVolumeMetadata(volumePath)
+		md, err = readVolumeMetadata(volumePath)
 		if err != nil {
 			msg := fmt.Sprintf("failed to read volume metadata for %v: %v", volumePath, err)
 			glog.Error(msg)
@@ -207,20 +339,9 @@ func (p *efsProvisioner) Provision(options controller.VolumeOptions) (*v1.Persis
 
 		glog.Infof("%s was reused since the preexisting volume metadata matches the PVC", volumePath)
 	} else {
-		gidAllocate := true
-		for k, v := range options.Parameters {
-			switch strings.ToLower(k) {
-			case "gidmin":
-				// Let allocator handle
-			case "gidmax":
-				// Let allocator handle
-			case "gidallocate":
-				b, err := strconv.ParseBool(v)
-				if err != nil {
-					return nil, fmt.Errorf("invalid value %s for parameter %s: %v", v, k, err)
-				}
-				gidAllocate = b
-			}
+		gidAllocate, err := gidAllocateOption(options)
+		if err != nil {
+			return nil, err
 		}
 
 		if gidAllocate {
@@ -231,25 +352,35 @@ func (p *efsProvisioner) Provision(options controller.VolumeOptions) (*v1.Persis
 			gid = &allocate
 		}
 
-		err := p.createVolume(volumePath, gid)
+		err = p.createVolume(volumePath, gid)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		var gidstr string
-		if gid != nil {
-			gidstr = strconv.Itoa(*gid)
-		}
+	var gidstr string
+	if gid != nil {
+		gidstr = strconv.Itoa(*gid)
+	}
 
-		if reuseVolumes {
-			writeVolumeMetadata(volumePath,
-				volumeMetadata{
-					GID:              gidstr,
-					PVCName:          options.PVC.Name,
-					PVCNamespace:     options.PVC.Namespace,
-					StorageClassName: helper.GetPersistentVolumeClaimClass(options.PVC),
-				})
+	var projectIDStr string
+	if enforceQuota {
+		projectID, err := p.enforceVolumeQuota(fs, volumePath, md, options)
+		if err != nil {
+			return nil, err
 		}
+		projectIDStr = strconv.Itoa(projectID)
+	}
+
+	if reuseVolumes || enforceQuota {
+		writeVolumeMetadata(volumePath,
+			volumeMetadata{
+				GID:              gidstr,
+				PVCName:          options.PVC.Name,
+				PVCNamespace:     options.PVC.Namespace,
+				StorageClassName: helper.GetPersistentVolumeClaimClass(options.PVC),
+				ProjectID:        projectIDStr,
+			})
 	}
 
 	mountOptions := []string{"vers=4.1"}
@@ -257,15 +388,24 @@ func (p *efsProvisioner) Provision(options controller.VolumeOptions) (*v1.Persis
 		mountOptions = options.MountOptions
 	}
 
-	remotePath, err := p.getRemotePath(options)
+	remotePath, err := p.getRemotePath(fs, options)
 	if err != nil {
 		glog.Errorf("Failed to get remote path: %v", err)
 		return nil, err
 	}
 
+	annotations := map[string]string{
+		fileSystemIDAnnotation: fs.fileSystemID,
+		awsRegionAnnotation:    fs.region,
+	}
+	if gid != nil {
+		annotations[gidallocator.VolumeGidAnnotationKey] = strconv.FormatInt(int64(*gid), 10)
+	}
+
 	pv := &v1.PersistentVolume{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: options.PVName,
+			Name:        options.PVName,
+			Annotations: annotations,
 		},
 		Spec: v1.PersistentVolumeSpec{
 			PersistentVolumeReclaimPolicy: options.PersistentVolumeReclaimPolicy,
@@ -275,7 +415,7 @@ func (p *efsProvisioner) Provision(options controller.VolumeOptions) (*v1.Persis
 			},
 			PersistentVolumeSource: v1.PersistentVolumeSource{
 				NFS: &v1.NFSVolumeSource{
-					Server:   p.dnsName,
+					Server:   fs.dnsName,
 					Path:     remotePath,
 					ReadOnly: false,
 				},
@@ -284,11 +424,12 @@ func (p *efsProvisioner) Provision(options controller.VolumeOptions) (*v1.Persis
 		},
 	}
 
-	if gid != nil {
-		pv.ObjectMeta.Annotations = map[string]string{
-			gidallocator.VolumeGidAnnotationKey: strconv.FormatInt(int64(*gid), 10),
-		}
-	}
+	p.metrics.trackVolume(options.PVName, provisionedVolume{
+		path:             volumePath,
+		pvcNamespace:     options.PVC.Namespace,
+		pvcName:          options.PVC.Name,
+		storageClassName: helper.GetPersistentVolumeClaimClass(options.PVC),
+	})
 
 	return pv, nil
 }
@@ -321,20 +462,20 @@ func (p *efsProvisioner) createVolume(path string, gid *int) error {
 	return nil
 }
 
-func (p *efsProvisioner) getLocalPath(options controller.VolumeOptions) (string, error) {
+func (p *efsProvisioner) getLocalPath(fs *mountedFilesystem, options controller.VolumeOptions) (string, error) {
 	dirname, err := p.getDirectoryName(options)
 	if err != nil {
 		return "", err
 	}
-	return path.Join(p.mountpoint, dirname), nil
+	return path.Join(fs.mountpoint, dirname), nil
 }
 
-func (p *efsProvisioner) getRemotePath(options controller.VolumeOptions) (string, error) {
+func (p *efsProvisioner) getRemotePath(fs *mountedFilesystem, options controller.VolumeOptions) (string, error) {
 	dirname, err := p.getDirectoryName(options)
 	if err != nil {
 		return "", err
 	}
-	sourcePath := path.Clean(strings.Replace(p.source, p.dnsName+":", "", 1))
+	sourcePath := path.Clean(strings.Replace(fs.source, fs.dnsName+":", "", 1))
 	return path.Join(sourcePath, dirname), nil
 }
 
@@ -365,39 +506,89 @@ func (p *efsProvisioner) getDirectoryName(options controller.VolumeOptions) (str
 // Delete removes the storage asset that was created by Provision represented
 // by the given PV.
 func (p *efsProvisioner) Delete(volume *v1.PersistentVolume) error {
+	fileSystemID, region := p.volumeFilesystemOptions(volume)
+
+	if accessPointID, ok := volume.Annotations[accessPointIDAnnotation]; ok {
+		//TODO ignorederror
+		if err := p.allocator.Release(volume); err != nil {
+			return err
+		}
+
+		creds, err := p.credentialsForSecret(
+			volume.Annotations[awsCredentialsSecretNameAnnotation],
+			volume.Annotations[awsCredentialsSecretNamespaceAnnotation],
+			region,
+		)
+		if err != nil {
+			return err
+		}
+
+		svc, err := efsClient(region, creds)
+		if err != nil {
+			return err
+		}
+
+		if err := deleteAccessPoint(svc, accessPointID); err != nil {
+			return err
+		}
+
+		p.metrics.untrackVolume(volume.Name)
+
+		return nil
+	}
+
 	//TODO ignorederror
 	err := p.allocator.Release(volume)
 	if err != nil {
 		return err
 	}
 
-	path, err := p.getLocalPathToDelete(volume.Spec.NFS)
+	fs, err := p.getFilesystem(fileSystemID, region, volume.Spec.NFS.Server)
 	if err != nil {
 		return err
 	}
 
-	glog.Infof("Deleting %s", path)
+	localPath, err := p.getLocalPathToDelete(fs, volume.Spec.NFS)
+	if err != nil {
+		return err
+	}
 
-	if err := os.RemoveAll(path); err != nil {
+	if md, err := readVolumeMetadata(localPath); err != nil {
+		glog.Warningf("failed to read volume metadata for %v, any allocated project ID won't be released: %v", localPath, err)
+	} else if md != nil && md.ProjectID != "" {
+		if projectID, err := strconv.Atoi(md.ProjectID); err != nil {
+			glog.Warningf("volume metadata for %v contains an invalid project ID value %v, won't be released: %v", localPath, md.ProjectID, err)
+		} else {
+			releaseProjectQuota(fs.mountpoint, projectID)
+			fs.projectIDs.release(projectID)
+		}
+	}
+	p.quotaEnforcer.untrack(volume.Name)
+
+	glog.Infof("Deleting %s", localPath)
+
+	if err := os.RemoveAll(localPath); err != nil {
 		return err
 	}
 
+	p.metrics.untrackVolume(volume.Name)
+
 	return nil
 }
 
-func (p *efsProvisioner) getLocalPathToDelete(nfs *v1.NFSVolumeSource) (string, error) {
-	if nfs.Server != p.dnsName {
-		return "", fmt.Errorf("volume's NFS server %s is not equal to the server %s from which this provisioner creates volumes", nfs.Server, p.dnsName)
+func (p *efsProvisioner) getLocalPathToDelete(fs *mountedFilesystem, nfs *v1.NFSVolumeSource) (string, error) {
+	if nfs.Server != fs.dnsName {
+		return "", fmt.Errorf("volume's NFS server %s is not equal to the server %s from which this provisioner creates volumes", nfs.Server, fs.dnsName)
 	}
 
-	sourcePath := path.Clean(strings.Replace(p.source, p.dnsName+":", "", 1))
+	sourcePath := path.Clean(strings.Replace(fs.source, fs.dnsName+":", "", 1))
 	if !strings.HasPrefix(nfs.Path, sourcePath) {
-		return "", fmt.Errorf("volume's NFS path %s is not a child of the server path %s mounted in this provisioner at %s", nfs.Path, p.source, p.mountpoint)
+		return "", fmt.Errorf("volume's NFS path %s is not a child of the server path %s mounted in this provisioner at %s", nfs.Path, fs.source, fs.mountpoint)
 	}
 
 	subpath := strings.Replace(nfs.Path, sourcePath, "", 1)
 
-	return path.Join(p.mountpoint, subpath), nil
+	return path.Join(fs.mountpoint, subpath), nil
 }
 
 // buildKubeConfig builds REST config based on master URL and kubeconfig path.
@@ -443,6 +634,10 @@ func main() {
 	// the controller
 	efsProvisioner := NewEFSProvisioner(clientset)
 
+	if mc := metricsCollectorFor(efsProvisioner); mc != nil {
+		serveMetrics(mc, metricsPort())
+	}
+
 	provisionerName := os.Getenv(provisionerNameKey)
 	if provisionerName == "" {
 		glog.Fatalf("environment variable %s is not set! Please set it.", provisionerNameKey)
@@ -13,27 +13,51 @@ import (
 	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/allocator"
 	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/controller"
 	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/gidreclaimer"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/kubernetes/pkg/apis/core/v1/helper"
 )
 
 // compile time check to make sure fileSystemReclaimer implements the GIDReclaimer interface
 var _ gidreclaimer.GIDReclaimer = &fileSystemReclaimer{}
 
-func newFileSystemReclaimer(basePath string) *fileSystemReclaimer {
-	return &fileSystemReclaimer{basePath}
+// newFileSystemReclaimer builds a reclaimer for the filesystem mounted at basePath.
+// resolveBasePath resolves the basePath to scan for a given StorageClass, covering
+// StorageClasses that select a different filesystem than the one basePath describes;
+// it falls back to basePath when it returns an error. resolveBasePath is expected to
+// route through getFilesystem, which reconstructs any volumeMetadata missing from
+// preexisting PVs the first time it hands out a given filesystem.
+func newFileSystemReclaimer(basePath string, client kubernetes.Interface, resolveBasePath func(classname string) (string, error)) *fileSystemReclaimer {
+	return &fileSystemReclaimer{
+		BasePath:        basePath,
+		Client:          client,
+		ResolveBasePath: resolveBasePath,
+	}
 }
 
 type fileSystemReclaimer struct {
 	BasePath string
+	Client   kubernetes.Interface
+
+	ResolveBasePath func(classname string) (string, error)
 }
 
-// Reclaim looks at every top level directory in the basepath and adds its gid to the given gidTable
+// Reclaim looks at every top level directory in the filesystem serving classname
+// and adds its gid to the given gidTable.
 func (f *fileSystemReclaimer) Reclaim(classname string, gidtable *allocator.MinMaxAllocator) error {
-	glog.Infof("adding gids for any existing directories under %s to the gid table", f.BasePath)
+	basePath := f.BasePath
+	if f.ResolveBasePath != nil {
+		if resolved, err := f.ResolveBasePath(classname); err != nil {
+			glog.Warningf("failed to resolve filesystem for storage class %v, falling back to %v: %v", classname, basePath, err)
+		} else {
+			basePath = resolved
+		}
+	}
+
+	glog.Infof("adding gids for any existing directories under %s to the gid table", basePath)
 
-	entries, err := ioutil.ReadDir(f.BasePath)
+	entries, err := ioutil.ReadDir(basePath)
 	if err != nil {
-		glog.Errorf("failed to list contents of %v: %v", f.BasePath, err)
+		glog.Errorf("failed to list contents of %v: %v", basePath, err)
 		return err
 	}
 
@@ -42,7 +66,7 @@ func (f *fileSystemReclaimer) Reclaim(classname string, gidtable *allocator.MinM
 			continue
 		}
 
-		mddir := path.Join(f.BasePath, entry.Name())
+		mddir := path.Join(basePath, entry.Name())
 
 		md, err := readVolumeMetadata(mddir)
 		if err != nil {
@@ -0,0 +1,343 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/controller"
+	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/gidallocator"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/kubernetes/pkg/apis/core/v1/helper"
+)
+
+const (
+	fileSystemIDParam = "fileSystemId"
+	awsRegionParam    = "awsRegion"
+	dnsNameParam      = "dnsName"
+
+	provisionerRootKey     = "PROVISIONER_ROOT"
+	defaultProvisionerRoot = "/persistentvolumes"
+
+	// fileSystemIDAnnotation and awsRegionAnnotation record which filesystem a PV
+	// was provisioned against, so Delete can find it again without needing the
+	// StorageClass (which may have since been edited or deleted). Absent on PVs
+	// provisioned before multi-filesystem support, in which case they default to
+	// the provisioner's own FILE_SYSTEM_ID/AWS_REGION.
+	fileSystemIDAnnotation = "efs.provisioner/file-system-id"
+	awsRegionAnnotation    = "efs.provisioner/aws-region"
+)
+
+// mountedFilesystem records where one EFS filesystem is mounted locally. It
+// doesn't carry an AWS client: StorageClasses provisioning against this
+// filesystem may each supply their own credentials, so clients are built
+// per-call by efsClient instead of cached here.
+type mountedFilesystem struct {
+	fileSystemID string
+	region       string
+	dnsName      string
+	mountpoint   string
+	source       string
+
+	projectIDs *projectIDAllocator
+
+	quotaOnce   sync.Once
+	quotaNative bool
+
+	// reconstructMutex guards reconstructDone, which is set only once the
+	// reconstruction pass in reconstructFilesystemVolumes actually completes.
+	// A sync.Once can't be retried, so a transient error (e.g. a PersistentVolumes
+	// list call failing) would otherwise permanently disable reconstruction for
+	// the life of the pod; this gate lets the next caller try again instead.
+	reconstructMutex sync.Mutex
+	reconstructDone  bool
+}
+
+// supportsProjectQuota reports whether fs's mountpoint supports XFS project
+// quotas, probing it once and caching the result. EFS, mounted over NFS, never
+// does; this exists so local or future filesystem types can opt into native
+// enforcement instead of the du-based fallback.
+func (fs *mountedFilesystem) supportsProjectQuota() bool {
+	fs.quotaOnce.Do(func() {
+		out, err := exec.Command("xfs_quota", "-x", "-c", "print", fs.mountpoint).CombinedOutput()
+		fs.quotaNative = err == nil
+		if err != nil {
+			glog.Infof("xfs project quotas not available on %s, falling back to usage-based quota enforcement: %v, output: %s", fs.mountpoint, err, out)
+		}
+	})
+	return fs.quotaNative
+}
+
+// filesystemKey returns the map key a StorageClass's fileSystemId/awsRegion parameters
+// resolve to.
+func filesystemKey(fileSystemID, region string) string {
+	return fileSystemID + "/" + region
+}
+
+// filesystemOptions resolves the fileSystemId, awsRegion and optional dnsName
+// StorageClass parameters, defaulting to the filesystem the provisioner was
+// started against.
+func (p *efsProvisioner) filesystemOptions(options controller.VolumeOptions) (fileSystemID, region, dnsName string) {
+	fileSystemID = options.Parameters[fileSystemIDParam]
+	if fileSystemID == "" {
+		fileSystemID = p.defaultFileSystemID
+	}
+
+	region = options.Parameters[awsRegionParam]
+	if region == "" {
+		region = p.defaultRegion
+	}
+
+	dnsName = options.Parameters[dnsNameParam]
+
+	return fileSystemID, region, dnsName
+}
+
+// getFilesystem returns the mountedFilesystem for fileSystemID/region, mounting it
+// on demand under a per-filesystem subdirectory of p.root if it isn't already
+// mounted. Concurrent callers asking for the same filesystem block on the same mount.
+// The first caller to obtain a given filesystem, whether newly mounted here or
+// already mounted when the provisioner started, triggers a one-time reconstruction
+// of any volumeMetadata missing from preexisting PVs on that filesystem.
+func (p *efsProvisioner) getFilesystem(fileSystemID, region, dnsName string) (*mountedFilesystem, error) {
+	key := filesystemKey(fileSystemID, region)
+
+	p.mutex.Lock()
+
+	fs, ok := p.filesystems[key]
+	if !ok {
+		if dnsName == "" {
+			dnsName = getDNSName(fileSystemID, region)
+		}
+
+		mountpoint, source, err := getMount(dnsName)
+		if err != nil {
+			mountpoint = path.Join(p.root, fileSystemID)
+			if mountErr := mountFilesystem(dnsName, mountpoint); mountErr != nil {
+				p.mutex.Unlock()
+				return nil, mountErr
+			}
+
+			mountpoint, source, err = getMount(dnsName)
+			if err != nil {
+				p.mutex.Unlock()
+				return nil, fmt.Errorf("mounted %s at %s but couldn't find the resulting mount entry: %v", dnsName, mountpoint, err)
+			}
+		}
+
+		fs = &mountedFilesystem{
+			fileSystemID: fileSystemID,
+			region:       region,
+			dnsName:      dnsName,
+			mountpoint:   mountpoint,
+			source:       source,
+			projectIDs:   newProjectIDAllocator(),
+		}
+
+		p.filesystems[key] = fs
+	}
+
+	p.mutex.Unlock()
+
+	reconstructFilesystemVolumes(p, fs)
+
+	return fs, nil
+}
+
+// mountFilesystem mounts the EFS filesystem served at dnsName onto mountpoint using
+// NFSv4.1, creating mountpoint first if necessary.
+func mountFilesystem(dnsName, mountpoint string) error {
+	if err := os.MkdirAll(mountpoint, 0755); err != nil {
+		return fmt.Errorf("failed to create mountpoint %s: %v", mountpoint, err)
+	}
+
+	glog.Infof("mounting %s:/ at %s", dnsName, mountpoint)
+
+	cmd := exec.Command("mount", "-t", "nfs4", "-o", "vers=4.1", dnsName+":/", mountpoint)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("mount %s at %s failed: %v, output: %s", dnsName, mountpoint, err, out)
+	}
+
+	return nil
+}
+
+// volumeFilesystemOptions resolves the fileSystemId/awsRegion a PV was annotated
+// with at provisioning time, falling back to the provisioner's own defaults for
+// PVs provisioned before multi-filesystem support existed.
+func (p *efsProvisioner) volumeFilesystemOptions(volume *v1.PersistentVolume) (fileSystemID, region string) {
+	fileSystemID = volume.Annotations[fileSystemIDAnnotation]
+	if fileSystemID == "" {
+		fileSystemID = p.defaultFileSystemID
+	}
+
+	region = volume.Annotations[awsRegionAnnotation]
+	if region == "" {
+		region = p.defaultRegion
+	}
+
+	return fileSystemID, region
+}
+
+// reconstructFilesystemVolumes lists every PersistentVolume in the cluster bound
+// to fs and, for any whose local directory exists but has no volumeMetadata file,
+// synthesizes one from the PV/PVC. This covers directories created before
+// reuseVolumes was enabled, or by a provisioner version that predates
+// volumeMetadata entirely, so upgrading to reuseVolumes on a cluster with
+// preexisting PVs doesn't orphan them from the GID allocator. It also reconciles
+// quota state for volumes whose metadata already records a ProjectID, since that
+// only lives in memory otherwise: see reconcileVolumeQuota. Runs once per fs, the
+// first time getFilesystem hands it out, whether that's the filesystem the
+// provisioner started against or one mounted later on demand for another
+// StorageClass, and is retried on the next call if the PersistentVolumes list
+// fails. Borrowed from the reconstruction pattern in the kubelet's volume
+// reconciler.
+func reconstructFilesystemVolumes(p *efsProvisioner, fs *mountedFilesystem) {
+	fs.reconstructMutex.Lock()
+	defer fs.reconstructMutex.Unlock()
+
+	if fs.reconstructDone {
+		return
+	}
+
+	glog.Infof("reconstructing volume metadata from PersistentVolumes bound to %s", fs.dnsName)
+
+	sourcePath := path.Clean(strings.Replace(fs.source, fs.dnsName+":", "", 1))
+
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("failed to list PersistentVolumes for reconstruction, will retry on next use of %s: %v", fs.dnsName, err)
+		return
+	}
+
+	for _, pv := range pvs.Items {
+		if pv.Spec.NFS == nil || pv.Spec.NFS.Server != fs.dnsName {
+			continue
+		}
+
+		if !strings.HasPrefix(pv.Spec.NFS.Path, sourcePath) {
+			continue
+		}
+
+		subpath := strings.Replace(pv.Spec.NFS.Path, sourcePath, "", 1)
+		dir := path.Join(fs.mountpoint, subpath)
+
+		if err := reconstructVolume(p, fs, &pv, dir); err != nil {
+			glog.Warningf("failed to reconstruct volume metadata for PV %v at %v: %v", pv.Name, dir, err)
+		}
+	}
+
+	fs.reconstructDone = true
+}
+
+// reconstructVolume writes a volumeMetadata file for dir if one doesn't already exist,
+// deriving its contents from pv and, for the storage class name, the PVC it's bound to.
+// If dir already has metadata, it's left untouched, but its quota state is still
+// reconciled into fs/p's in-memory bookkeeping via reconcileVolumeQuota.
+func reconstructVolume(p *efsProvisioner, fs *mountedFilesystem, pv *v1.PersistentVolume, dir string) error {
+	stat, err := os.Stat(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !stat.IsDir() {
+		return nil
+	}
+
+	existing, err := readVolumeMetadata(dir)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		reconcileVolumeQuota(p, fs, dir, existing, pv)
+		return nil
+	}
+
+	if pv.Spec.ClaimRef == nil {
+		return errors.New("PV has no ClaimRef, can't determine its PVC")
+	}
+
+	pvc, err := p.client.CoreV1().PersistentVolumeClaims(pv.Spec.ClaimRef.Namespace).Get(pv.Spec.ClaimRef.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to fetch PVC %s/%s: %v", pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name, err)
+	}
+
+	gid := ""
+	if annotation, ok := pv.Annotations[gidallocator.VolumeGidAnnotationKey]; ok && annotation != "" {
+		gid = annotation
+	} else if statT, ok := stat.Sys().(*syscall.Stat_t); ok {
+		gid = strconv.FormatUint(uint64(statT.Gid), 10)
+	}
+
+	md := volumeMetadata{
+		GID:              gid,
+		PVCName:          pvc.Name,
+		PVCNamespace:     pvc.Namespace,
+		StorageClassName: helper.GetPersistentVolumeClaimClass(pvc),
+	}
+
+	glog.Infof("reconstructed volume metadata for %v from PV %v: %+v", dir, pv.Name, md)
+
+	return writeVolumeMetadata(dir, md)
+}
+
+// reconcileVolumeQuota restores a reused volume's project ID and, if fs falls
+// back to usage-based enforcement, its quotaEnforcer tracking, from the
+// ProjectID already recorded in its volumeMetadata. Both only otherwise live in
+// memory, so without this a provisioner restart would let a newly allocated
+// project ID collide with one already applied to dir, and would silently stop
+// enforcing capacity on every such volume until it's reprovisioned.
+func reconcileVolumeQuota(p *efsProvisioner, fs *mountedFilesystem, dir string, md *volumeMetadata, pv *v1.PersistentVolume) {
+	if md.ProjectID == "" {
+		return
+	}
+
+	projectID, err := strconv.Atoi(md.ProjectID)
+	if err != nil {
+		glog.Warningf("volume metadata for %v contains an invalid project ID value %v, won't be reconciled: %v", dir, md.ProjectID, err)
+		return
+	}
+
+	fs.projectIDs.reserve(projectID)
+
+	if fs.supportsProjectQuota() {
+		return
+	}
+
+	limit := pv.Spec.Capacity[v1.ResourceStorage]
+	p.quotaEnforcer.track(pv.Name, quotaEnforcedVolume{
+		path: dir,
+		pvc: &v1.ObjectReference{
+			Kind:      "PersistentVolumeClaim",
+			Namespace: md.PVCNamespace,
+			Name:      md.PVCName,
+		},
+		limitBytes: limit.Value(),
+	})
+}
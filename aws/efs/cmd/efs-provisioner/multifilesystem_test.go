@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/controller"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestFilesystemOptions(t *testing.T) {
+	p := &efsProvisioner{defaultFileSystemID: "fs-default", defaultRegion: "us-east-1"}
+
+	cases := []struct {
+		name           string
+		parameters     map[string]string
+		wantFileSystem string
+		wantRegion     string
+		wantDNSName    string
+	}{
+		{
+			name:           "defaults to the provisioner's filesystem",
+			parameters:     map[string]string{},
+			wantFileSystem: "fs-default",
+			wantRegion:     "us-east-1",
+		},
+		{
+			name:           "storage class can select a different filesystem and region",
+			parameters:     map[string]string{fileSystemIDParam: "fs-other", awsRegionParam: "eu-west-1"},
+			wantFileSystem: "fs-other",
+			wantRegion:     "eu-west-1",
+		},
+		{
+			name:           "storage class can override just the region",
+			parameters:     map[string]string{awsRegionParam: "eu-west-1"},
+			wantFileSystem: "fs-default",
+			wantRegion:     "eu-west-1",
+		},
+		{
+			name:           "dnsName parameter passes through",
+			parameters:     map[string]string{fileSystemIDParam: "fs-other", dnsNameParam: "fs-other.efs.eu-west-1.amazonaws.com"},
+			wantFileSystem: "fs-other",
+			wantRegion:     "us-east-1",
+			wantDNSName:    "fs-other.efs.eu-west-1.amazonaws.com",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fileSystemID, region, dnsName := p.filesystemOptions(controller.VolumeOptions{Parameters: c.parameters})
+
+			if fileSystemID != c.wantFileSystem {
+				t.Errorf("fileSystemID = %q, want %q", fileSystemID, c.wantFileSystem)
+			}
+			if region != c.wantRegion {
+				t.Errorf("region = %q, want %q", region, c.wantRegion)
+			}
+			if dnsName != c.wantDNSName {
+				t.Errorf("dnsName = %q, want %q", dnsName, c.wantDNSName)
+			}
+		})
+	}
+}
+
+func TestVolumeFilesystemOptions(t *testing.T) {
+	p := &efsProvisioner{defaultFileSystemID: "fs-default", defaultRegion: "us-east-1"}
+
+	cases := []struct {
+		name           string
+		annotations    map[string]string
+		wantFileSystem string
+		wantRegion     string
+	}{
+		{
+			name:           "no annotations falls back to the provisioner's defaults",
+			annotations:    nil,
+			wantFileSystem: "fs-default",
+			wantRegion:     "us-east-1",
+		},
+		{
+			name:           "annotations from provisioning time take precedence",
+			annotations:    map[string]string{fileSystemIDAnnotation: "fs-other", awsRegionAnnotation: "eu-west-1"},
+			wantFileSystem: "fs-other",
+			wantRegion:     "eu-west-1",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			volume := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Annotations: c.annotations}}
+
+			fileSystemID, region := p.volumeFilesystemOptions(volume)
+
+			if fileSystemID != c.wantFileSystem {
+				t.Errorf("fileSystemID = %q, want %q", fileSystemID, c.wantFileSystem)
+			}
+			if region != c.wantRegion {
+				t.Errorf("region = %q, want %q", region, c.wantRegion)
+			}
+		})
+	}
+}
+
+func TestFilesystemKey(t *testing.T) {
+	if got, want := filesystemKey("fs-1234", "us-east-1"), "fs-1234/us-east-1"; got != want {
+		t.Errorf("filesystemKey() = %q, want %q", got, want)
+	}
+}
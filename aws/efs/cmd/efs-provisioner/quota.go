@@ -0,0 +1,276 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/controller"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	enforceQuotaKey = "enforceQuota"
+
+	// quotaExceededAnnotation is set to "true" on a PV by the quota enforcer's
+	// fallback path when a volume without native project quota support has grown
+	// past its capacity, and cleared back to "false" once it's back under.
+	quotaExceededAnnotation = "efs.provisioner/quota-exceeded"
+
+	minProjectID = 1
+	maxProjectID = 2097151
+
+	quotaCheckInterval = 5 * time.Minute
+)
+
+// enforceQuotaOption determines whether capacity enforcement should be applied to
+// the volume, defaulting to false, per the enforceQuota StorageClass parameter.
+func enforceQuotaOption(options controller.VolumeOptions) (bool, error) {
+	enforceStr, ok := options.Parameters[enforceQuotaKey]
+	if !ok || enforceStr == "" {
+		return false, nil
+	}
+
+	enforce, err := strconv.ParseBool(enforceStr)
+	if err != nil {
+		return false, fmt.Errorf("invalid value %s for parameter %s: %v", enforceStr, enforceQuotaKey, err)
+	}
+
+	return enforce, nil
+}
+
+// projectIDAllocator hands out unique XFS project IDs for quota enforcement.
+// Project IDs are scoped to the filesystem they're applied on, so there's one
+// allocator per mountedFilesystem.
+type projectIDAllocator struct {
+	mutex     sync.Mutex
+	allocated map[int]bool
+	next      int
+}
+
+func newProjectIDAllocator() *projectIDAllocator {
+	return &projectIDAllocator{allocated: make(map[int]bool), next: minProjectID}
+}
+
+func (a *projectIDAllocator) allocate() (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for i := minProjectID; i <= maxProjectID; i++ {
+		id := a.next
+		a.next++
+		if a.next > maxProjectID {
+			a.next = minProjectID
+		}
+		if !a.allocated[id] {
+			a.allocated[id] = true
+			return id, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no free project IDs in range %d-%d", minProjectID, maxProjectID)
+}
+
+// reserve marks id as allocated without handing it out, for a project ID read
+// back from a reused volume's metadata.
+func (a *projectIDAllocator) reserve(id int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.allocated[id] = true
+}
+
+func (a *projectIDAllocator) release(id int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.allocated, id)
+}
+
+// applyProjectQuota assigns dir the given XFS project ID and sets a hard block
+// limit of limitBytes on it. Returns an error if the underlying filesystem
+// doesn't support project quotas, which is the common case for an EFS NFS mount.
+func applyProjectQuota(mountpoint, dir string, projectID int, limitBytes int64) error {
+	if out, err := exec.Command("setfattr", "-n", "trusted.projid", "-v", strconv.Itoa(projectID), dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("setfattr failed on %s: %v, output: %s", dir, err, out)
+	}
+
+	setupCmd := fmt.Sprintf("project -s -p %s %d", dir, projectID)
+	if out, err := exec.Command("xfs_quota", "-x", "-c", setupCmd, mountpoint).CombinedOutput(); err != nil {
+		return fmt.Errorf("xfs_quota project setup failed for %s: %v, output: %s", dir, err, out)
+	}
+
+	limitCmd := fmt.Sprintf("limit -p bhard=%d %d", limitBytes, projectID)
+	if out, err := exec.Command("xfs_quota", "-x", "-c", limitCmd, mountpoint).CombinedOutput(); err != nil {
+		return fmt.Errorf("xfs_quota limit failed for %s: %v, output: %s", dir, err, out)
+	}
+
+	return nil
+}
+
+// releaseProjectQuota clears the hard block limit applyProjectQuota set for projectID.
+func releaseProjectQuota(mountpoint string, projectID int) {
+	limitCmd := fmt.Sprintf("limit -p bhard=0 %d", projectID)
+	if out, err := exec.Command("xfs_quota", "-x", "-c", limitCmd, mountpoint).CombinedOutput(); err != nil {
+		glog.Warningf("failed to release xfs project quota %d on %s: %v, output: %s", projectID, mountpoint, err, out)
+	}
+}
+
+// quotaEnforcedVolume is the bookkeeping the quotaEnforcer needs to measure and
+// report on a volume whose filesystem doesn't support native project quotas.
+type quotaEnforcedVolume struct {
+	path       string
+	pvc        *v1.ObjectReference
+	limitBytes int64
+}
+
+// quotaEnforcer periodically measures disk usage for volumes whose filesystem
+// doesn't support XFS project quotas, since that's the common case for EFS, and
+// reports breaches via a Warning event on the PVC and the quotaExceededAnnotation
+// on the PV.
+type quotaEnforcer struct {
+	client   kubernetes.Interface
+	recorder record.EventRecorder
+	usage    VolumeMetricsProvider
+
+	mutex   sync.Mutex
+	volumes map[string]quotaEnforcedVolume // keyed by PV name
+}
+
+func newQuotaEnforcer(client kubernetes.Interface, recorder record.EventRecorder) *quotaEnforcer {
+	return &quotaEnforcer{
+		client:   client,
+		recorder: recorder,
+		usage:    duMetrics{},
+		volumes:  make(map[string]quotaEnforcedVolume),
+	}
+}
+
+func (q *quotaEnforcer) track(pvName string, v quotaEnforcedVolume) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.volumes[pvName] = v
+}
+
+func (q *quotaEnforcer) untrack(pvName string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.volumes, pvName)
+}
+
+// checkAll measures every tracked volume's usage against its limit, run
+// periodically via wait.Forever.
+func (q *quotaEnforcer) checkAll() {
+	q.mutex.Lock()
+	volumes := make(map[string]quotaEnforcedVolume, len(q.volumes))
+	for pvName, v := range q.volumes {
+		volumes[pvName] = v
+	}
+	q.mutex.Unlock()
+
+	for pvName, v := range volumes {
+		metrics, err := q.usage.GetMetrics(v.path)
+		if err != nil {
+			glog.Warningf("quota enforcer: failed to measure usage of %s: %v", v.path, err)
+			continue
+		}
+
+		exceeded := metrics.Used > v.limitBytes
+		if exceeded {
+			glog.Warningf("volume %s at %s is using %d bytes, over its %d byte limit", pvName, v.path, metrics.Used, v.limitBytes)
+			q.recorder.Eventf(v.pvc, v1.EventTypeWarning, "QuotaExceeded", "volume is using %d bytes, over its %d byte limit", metrics.Used, v.limitBytes)
+		}
+
+		if err := q.setQuotaExceededAnnotation(pvName, exceeded); err != nil {
+			glog.Warningf("quota enforcer: failed to update annotation on PV %s: %v", pvName, err)
+		}
+	}
+}
+
+// enforceVolumeQuota allocates (or, for a reused volume, reserves the existing)
+// project ID for volumePath and applies a capacity limit to it, falling back to
+// periodic usage-based enforcement when fs doesn't support native XFS project
+// quotas. It returns the project ID to persist in the volume's metadata.
+func (p *efsProvisioner) enforceVolumeQuota(fs *mountedFilesystem, volumePath string, md *volumeMetadata, options controller.VolumeOptions) (int, error) {
+	var projectID int
+
+	if md != nil && md.ProjectID != "" {
+		existing, err := strconv.Atoi(md.ProjectID)
+		if err != nil {
+			return 0, fmt.Errorf("volume metadata contains an invalid project ID value: %v", md.ProjectID)
+		}
+		projectID = existing
+		fs.projectIDs.reserve(projectID)
+	} else {
+		allocated, err := fs.projectIDs.allocate()
+		if err != nil {
+			return 0, err
+		}
+		projectID = allocated
+	}
+
+	limit := options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+	enforced := quotaEnforcedVolume{
+		path: volumePath,
+		pvc: &v1.ObjectReference{
+			Kind:      "PersistentVolumeClaim",
+			Namespace: options.PVC.Namespace,
+			Name:      options.PVC.Name,
+			UID:       options.PVC.UID,
+		},
+		limitBytes: limit.Value(),
+	}
+
+	if fs.supportsProjectQuota() {
+		if err := applyProjectQuota(fs.mountpoint, volumePath, projectID, limit.Value()); err != nil {
+			glog.Warningf("failed to apply native project quota to %s, falling back to usage-based enforcement: %v", volumePath, err)
+			p.quotaEnforcer.track(options.PVName, enforced)
+		} else {
+			p.quotaEnforcer.untrack(options.PVName)
+		}
+	} else {
+		p.quotaEnforcer.track(options.PVName, enforced)
+	}
+
+	return projectID, nil
+}
+
+func (q *quotaEnforcer) setQuotaExceededAnnotation(pvName string, exceeded bool) error {
+	pv, err := q.client.CoreV1().PersistentVolumes().Get(pvName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	value := strconv.FormatBool(exceeded)
+	if pv.Annotations[quotaExceededAnnotation] == value {
+		return nil
+	}
+
+	if pv.Annotations == nil {
+		pv.Annotations = map[string]string{}
+	}
+	pv.Annotations[quotaExceededAnnotation] = value
+
+	_, err = q.client.CoreV1().PersistentVolumes().Update(pv)
+	return err
+}
@@ -0,0 +1,80 @@
+package main
+
+import "testing"
+
+func TestProjectIDAllocatorAllocate(t *testing.T) {
+	a := newProjectIDAllocator()
+
+	first, err := a.allocate()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first != minProjectID {
+		t.Errorf("first allocated ID = %d, want %d", first, minProjectID)
+	}
+
+	second, err := a.allocate()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if second == first {
+		t.Errorf("allocate() returned %d twice", first)
+	}
+}
+
+func TestProjectIDAllocatorRelease(t *testing.T) {
+	a := newProjectIDAllocator()
+
+	id, err := a.allocate()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	a.release(id)
+
+	if _, ok := a.allocated[id]; ok {
+		t.Fatalf("id %d still marked allocated after release", id)
+	}
+}
+
+func TestProjectIDAllocatorReserve(t *testing.T) {
+	a := newProjectIDAllocator()
+
+	a.reserve(42)
+
+	if !a.allocated[42] {
+		t.Fatalf("reserve(42) did not mark 42 as allocated")
+	}
+}
+
+func TestProjectIDAllocatorWraparound(t *testing.T) {
+	a := newProjectIDAllocator()
+	a.next = maxProjectID
+
+	first, err := a.allocate()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first != maxProjectID {
+		t.Fatalf("allocate() = %d, want %d", first, maxProjectID)
+	}
+
+	second, err := a.allocate()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if second != minProjectID {
+		t.Fatalf("allocate() after wraparound = %d, want %d", second, minProjectID)
+	}
+}
+
+func TestProjectIDAllocatorExhausted(t *testing.T) {
+	a := newProjectIDAllocator()
+	for i := minProjectID; i <= maxProjectID; i++ {
+		a.reserve(i)
+	}
+
+	if _, err := a.allocate(); err == nil {
+		t.Fatalf("expected an error when no project IDs remain, got none")
+	}
+}
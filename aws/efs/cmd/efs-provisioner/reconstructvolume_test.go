@@ -0,0 +1,212 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/gidallocator"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestReconstructProvisioner builds a minimal efsProvisioner/mountedFilesystem
+// pair suitable for exercising reconstructVolume, which needs both to reconcile
+// quota state alongside metadata.
+func newTestReconstructProvisioner(objects ...runtime.Object) (*efsProvisioner, *mountedFilesystem) {
+	p := &efsProvisioner{
+		client:        fake.NewSimpleClientset(objects...),
+		quotaEnforcer: newQuotaEnforcer(fake.NewSimpleClientset(), nil),
+	}
+	fs := &mountedFilesystem{projectIDs: newProjectIDAllocator()}
+	return p, fs
+}
+
+func TestReconstructVolumeMissingDirectory(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "reconstruct")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	p, fs := newTestReconstructProvisioner()
+	dir := path.Join(tmp, "does-not-exist")
+
+	pv := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv-1"}}
+
+	if err := reconstructVolume(p, fs, pv, dir); err != nil {
+		t.Fatalf("unexpected error for a missing directory: %v", err)
+	}
+
+	if md, err := readVolumeMetadata(dir); err != nil || md != nil {
+		t.Fatalf("expected no metadata to be written, got %+v, err %v", md, err)
+	}
+}
+
+func TestReconstructVolumeAlreadyHasMetadata(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "reconstruct")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	existing := volumeMetadata{GID: "1000", PVCName: "existing-pvc", PVCNamespace: "default", StorageClassName: "efs"}
+	if err := writeVolumeMetadata(tmp, existing); err != nil {
+		t.Fatalf("failed to seed existing metadata: %v", err)
+	}
+
+	p, fs := newTestReconstructProvisioner()
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: v1.PersistentVolumeSpec{
+			ClaimRef: &v1.ObjectReference{Name: "other-pvc", Namespace: "default"},
+		},
+	}
+
+	if err := reconstructVolume(p, fs, pv, tmp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	md, err := readVolumeMetadata(tmp)
+	if err != nil {
+		t.Fatalf("failed to read back metadata: %v", err)
+	}
+	if md.PVCName != existing.PVCName {
+		t.Errorf("existing metadata was overwritten: got PVCName %q, want %q", md.PVCName, existing.PVCName)
+	}
+}
+
+func TestReconstructVolumeNoClaimRef(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "reconstruct")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	p, fs := newTestReconstructProvisioner()
+	pv := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv-1"}}
+
+	if err := reconstructVolume(p, fs, pv, tmp); err == nil {
+		t.Fatalf("expected an error for a PV with no ClaimRef, got none")
+	}
+}
+
+func TestReconstructVolumeReconcilesQuotaFromExistingMetadata(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "reconstruct")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	existing := volumeMetadata{
+		GID:              "1000",
+		PVCName:          "existing-pvc",
+		PVCNamespace:     "default",
+		StorageClassName: "efs",
+		ProjectID:        "42",
+	}
+	if err := writeVolumeMetadata(tmp, existing); err != nil {
+		t.Fatalf("failed to seed existing metadata: %v", err)
+	}
+
+	p, fs := newTestReconstructProvisioner()
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: v1.PersistentVolumeSpec{
+			ClaimRef: &v1.ObjectReference{Name: "existing-pvc", Namespace: "default"},
+			Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse("5Gi")},
+		},
+	}
+
+	if err := reconstructVolume(p, fs, pv, tmp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !fs.projectIDs.allocated[42] {
+		t.Errorf("expected project ID 42 to be reserved after reconciliation")
+	}
+
+	tracked, ok := p.quotaEnforcer.volumes["pv-1"]
+	if !ok {
+		t.Fatalf("expected quota enforcer to track pv-1")
+	}
+	if tracked.path != tmp {
+		t.Errorf("tracked path = %q, want %q", tracked.path, tmp)
+	}
+	if want := resource.MustParse("5Gi").Value(); tracked.limitBytes != want {
+		t.Errorf("tracked limitBytes = %d, want %d", tracked.limitBytes, want)
+	}
+}
+
+func TestReconstructVolumeFromPVCAndAnnotation(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "reconstruct")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pvc", Namespace: "my-ns"},
+		Spec:       v1.PersistentVolumeClaimSpec{StorageClassName: stringPtr("efs")},
+	}
+	p, fs := newTestReconstructProvisioner(pvc)
+
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pv-1",
+			Annotations: map[string]string{gidallocator.VolumeGidAnnotationKey: "2000"},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			ClaimRef: &v1.ObjectReference{Name: "my-pvc", Namespace: "my-ns"},
+		},
+	}
+
+	if err := reconstructVolume(p, fs, pv, tmp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	md, err := readVolumeMetadata(tmp)
+	if err != nil {
+		t.Fatalf("failed to read back reconstructed metadata: %v", err)
+	}
+	if md == nil {
+		t.Fatal("expected metadata to be written, got none")
+	}
+	if md.GID != "2000" {
+		t.Errorf("GID = %q, want %q", md.GID, "2000")
+	}
+	if md.PVCName != "my-pvc" || md.PVCNamespace != "my-ns" {
+		t.Errorf("PVCName/PVCNamespace = %q/%q, want %q/%q", md.PVCName, md.PVCNamespace, "my-pvc", "my-ns")
+	}
+	if md.StorageClassName != "efs" {
+		t.Errorf("StorageClassName = %q, want %q", md.StorageClassName, "efs")
+	}
+}
+
+func TestReconstructVolumeMissingPVC(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "reconstruct")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	p, fs := newTestReconstructProvisioner()
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: v1.PersistentVolumeSpec{
+			ClaimRef: &v1.ObjectReference{Name: "missing-pvc", Namespace: "my-ns"},
+		},
+	}
+
+	if err := reconstructVolume(p, fs, pv, tmp); err == nil {
+		t.Fatalf("expected an error when the PVC can't be fetched, got none")
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
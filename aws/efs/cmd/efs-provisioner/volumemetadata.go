@@ -19,6 +19,9 @@ type volumeMetadata struct {
 	PVCName          string `json:"pvcName"`
 	PVCNamespace     string `json:"pvcNamespace"`
 	StorageClassName string `json:"storageClassName"`
+	// ProjectID is the XFS project ID allocated for quota enforcement, set only
+	// when the enforceQuota StorageClass parameter is true.
+	ProjectID string `json:"projectId,omitempty"`
 }
 
 func (v volumeMetadata) GidAsUInt() (uint32, error) {
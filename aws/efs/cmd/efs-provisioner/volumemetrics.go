@@ -0,0 +1,269 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/controller"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsPortKey     = "METRICS_PORT"
+	metricsCacheTTLKey = "METRICS_CACHE_TTL"
+
+	defaultMetricsPort     = "8080"
+	defaultMetricsCacheTTL = 30 * time.Second
+)
+
+// VolumeMetrics holds the disk usage statistics for a single provisioned volume.
+type VolumeMetrics struct {
+	Capacity   int64
+	Available  int64
+	Used       int64
+	InodesFree int64
+}
+
+// VolumeMetricsProvider collects VolumeMetrics for the directory at path.
+type VolumeMetricsProvider interface {
+	GetMetrics(path string) (*VolumeMetrics, error)
+}
+
+// statfsMetrics collects Capacity, Available and InodesFree via syscall.Statfs.
+// It's cheap enough to call on every scrape.
+type statfsMetrics struct{}
+
+func (statfsMetrics) GetMetrics(path string) (*VolumeMetrics, error) {
+	var buf syscall.Statfs_t
+	if err := syscall.Statfs(path, &buf); err != nil {
+		return nil, fmt.Errorf("statfs %s failed: %v", path, err)
+	}
+
+	return &VolumeMetrics{
+		Capacity:   int64(buf.Blocks) * int64(buf.Bsize),
+		Available:  int64(buf.Bavail) * int64(buf.Bsize),
+		InodesFree: int64(buf.Ffree),
+	}, nil
+}
+
+// duMetrics collects the actual Used bytes by shelling out to `du -sb`, since
+// statfs on a network filesystem like EFS doesn't reflect real usage.
+type duMetrics struct{}
+
+func (duMetrics) GetMetrics(path string) (*VolumeMetrics, error) {
+	out, err := exec.Command("du", "-sb", path).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("du -sb %s failed: %v, output: %s", path, err, out)
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("unexpected output from du -sb %s: %q", path, out)
+	}
+
+	used, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse du output %q for %s: %v", fields[0], path, err)
+	}
+
+	return &VolumeMetrics{Used: used}, nil
+}
+
+type cachedMetricsEntry struct {
+	metrics   *VolumeMetrics
+	collected time.Time
+}
+
+// cachedMetrics wraps a VolumeMetricsProvider and memoizes its results per
+// path for ttl, so an expensive collector (duMetrics walking a large EFS
+// tree) doesn't run on every Prometheus scrape.
+type cachedMetrics struct {
+	provider VolumeMetricsProvider
+	ttl      time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]cachedMetricsEntry
+}
+
+func newCachedMetrics(provider VolumeMetricsProvider, ttl time.Duration) *cachedMetrics {
+	return &cachedMetrics{
+		provider: provider,
+		ttl:      ttl,
+		entries:  make(map[string]cachedMetricsEntry),
+	}
+}
+
+func (c *cachedMetrics) GetMetrics(path string) (*VolumeMetrics, error) {
+	c.mutex.Lock()
+	entry, ok := c.entries[path]
+	c.mutex.Unlock()
+	if ok && time.Since(entry.collected) < c.ttl {
+		return entry.metrics, nil
+	}
+
+	metrics, err := c.provider.GetMetrics(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	c.entries[path] = cachedMetricsEntry{metrics: metrics, collected: time.Now()}
+	c.mutex.Unlock()
+
+	return metrics, nil
+}
+
+// provisionedVolume is the bookkeeping metricsCollector needs to label and
+// locate each volume it reports on.
+type provisionedVolume struct {
+	path             string
+	pvcNamespace     string
+	pvcName          string
+	storageClassName string
+}
+
+// metricsCollector implements prometheus.Collector, reporting per-PV disk
+// usage for every volume the provisioner currently knows about.
+type metricsCollector struct {
+	statfs VolumeMetricsProvider
+	du     VolumeMetricsProvider
+
+	mutex   sync.Mutex
+	volumes map[string]provisionedVolume // keyed by PV name
+
+	bytesUsedDesc     *prometheus.Desc
+	bytesCapacityDesc *prometheus.Desc
+	inodesFreeDesc    *prometheus.Desc
+}
+
+func newMetricsCollector(cacheTTL time.Duration) *metricsCollector {
+	labels := []string{"persistentvolume", "namespace", "persistentvolumeclaim", "storageclass"}
+	return &metricsCollector{
+		statfs:  statfsMetrics{},
+		du:      newCachedMetrics(duMetrics{}, cacheTTL),
+		volumes: make(map[string]provisionedVolume),
+
+		bytesUsedDesc:     prometheus.NewDesc("efs_pv_bytes_used", "Bytes used in a provisioned EFS volume, as reported by du", labels, nil),
+		bytesCapacityDesc: prometheus.NewDesc("efs_pv_bytes_capacity", "Bytes capacity of the filesystem backing a provisioned EFS volume", labels, nil),
+		inodesFreeDesc:    prometheus.NewDesc("efs_pv_inodes_free", "Free inodes on the filesystem backing a provisioned EFS volume", labels, nil),
+	}
+}
+
+// trackVolume registers a provisioned volume so it's reported on subsequent scrapes.
+func (m *metricsCollector) trackVolume(pvName string, v provisionedVolume) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.volumes[pvName] = v
+}
+
+// untrackVolume stops reporting metrics for a deleted volume.
+func (m *metricsCollector) untrackVolume(pvName string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.volumes, pvName)
+}
+
+func (m *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.bytesUsedDesc
+	ch <- m.bytesCapacityDesc
+	ch <- m.inodesFreeDesc
+}
+
+func (m *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	m.mutex.Lock()
+	volumes := make(map[string]provisionedVolume, len(m.volumes))
+	for pvName, v := range m.volumes {
+		volumes[pvName] = v
+	}
+	m.mutex.Unlock()
+
+	for pvName, v := range volumes {
+		labels := []string{pvName, v.pvcNamespace, v.pvcName, v.storageClassName}
+
+		if sf, err := m.statfs.GetMetrics(v.path); err != nil {
+			glog.Warningf("failed to collect statfs metrics for %v: %v", v.path, err)
+		} else {
+			ch <- prometheus.MustNewConstMetric(m.bytesCapacityDesc, prometheus.GaugeValue, float64(sf.Capacity), labels...)
+			ch <- prometheus.MustNewConstMetric(m.inodesFreeDesc, prometheus.GaugeValue, float64(sf.InodesFree), labels...)
+		}
+
+		if du, err := m.du.GetMetrics(v.path); err != nil {
+			glog.Warningf("failed to collect du metrics for %v: %v", v.path, err)
+		} else {
+			ch <- prometheus.MustNewConstMetric(m.bytesUsedDesc, prometheus.GaugeValue, float64(du.Used), labels...)
+		}
+	}
+}
+
+// serveMetrics registers the collector on its own registry and starts the
+// /metrics HTTP handler on the given port. The server runs in the background.
+func serveMetrics(collector *metricsCollector, port string) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	go func() {
+		glog.Infof("serving volume metrics on :%s/metrics", port)
+		if err := http.ListenAndServe(":"+port, mux); err != nil {
+			glog.Errorf("metrics server exited: %v", err)
+		}
+	}()
+}
+
+// metricsCollectorFor returns the metricsCollector owned by p if p is an
+// *efsProvisioner, or nil otherwise.
+func metricsCollectorFor(p controller.Provisioner) *metricsCollector {
+	if ep, ok := p.(*efsProvisioner); ok {
+		return ep.metrics
+	}
+	return nil
+}
+
+func metricsPort() string {
+	if port := os.Getenv(metricsPortKey); port != "" {
+		return port
+	}
+	return defaultMetricsPort
+}
+
+func metricsCacheTTL() time.Duration {
+	ttl := os.Getenv(metricsCacheTTLKey)
+	if ttl == "" {
+		return defaultMetricsCacheTTL
+	}
+
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		glog.Warningf("invalid %s value %q, using default of %v: %v", metricsCacheTTLKey, ttl, defaultMetricsCacheTTL, err)
+		return defaultMetricsCacheTTL
+	}
+
+	return d
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestDuMetricsGetMetrics(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dumetrics")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := ioutil.WriteFile(path.Join(tmp, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("failed to write test file: %v", err)
+	}
+
+	metrics, err := duMetrics{}.GetMetrics(tmp)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if metrics.Used <= 0 {
+		t.Errorf("Used = %d, want a positive number of bytes", metrics.Used)
+	}
+}
+
+func TestDuMetricsGetMetricsMissingPath(t *testing.T) {
+	if _, err := duMetrics{}.GetMetrics("/does/not/exist"); err == nil {
+		t.Fatalf("expected an error for a path du can't read, got none")
+	}
+}
+
+// stubMetricsProvider returns metrics (or err) from a fixed list, one per call,
+// so cachedMetrics tests can tell whether the underlying provider was actually
+// invoked.
+type stubMetricsProvider struct {
+	calls   int
+	metrics []*VolumeMetrics
+	err     error
+}
+
+func (s *stubMetricsProvider) GetMetrics(path string) (*VolumeMetrics, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	m := s.metrics[s.calls]
+	s.calls++
+	return m, nil
+}
+
+func TestCachedMetricsReusesWithinTTL(t *testing.T) {
+	stub := &stubMetricsProvider{metrics: []*VolumeMetrics{{Used: 100}, {Used: 200}}}
+	c := newCachedMetrics(stub, time.Minute)
+
+	first, err := c.GetMetrics("/vol")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := c.GetMetrics("/vol")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if first != second {
+		t.Errorf("expected the cached metrics to be reused within the TTL")
+	}
+	if stub.calls != 1 {
+		t.Errorf("provider was called %d times, want 1", stub.calls)
+	}
+}
+
+func TestCachedMetricsRefreshesAfterTTL(t *testing.T) {
+	stub := &stubMetricsProvider{metrics: []*VolumeMetrics{{Used: 100}, {Used: 200}}}
+	c := newCachedMetrics(stub, time.Millisecond)
+
+	if _, err := c.GetMetrics("/vol"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	second, err := c.GetMetrics("/vol")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if second.Used != 200 {
+		t.Errorf("Used = %d, want 200 after the cache entry expired", second.Used)
+	}
+	if stub.calls != 2 {
+		t.Errorf("provider was called %d times, want 2", stub.calls)
+	}
+}
+
+func TestCachedMetricsCachesPerPath(t *testing.T) {
+	stub := &stubMetricsProvider{metrics: []*VolumeMetrics{{Used: 100}, {Used: 200}}}
+	c := newCachedMetrics(stub, time.Minute)
+
+	first, err := c.GetMetrics("/vol-a")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := c.GetMetrics("/vol-b")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if first.Used == second.Used {
+		t.Errorf("expected distinct paths to be cached independently")
+	}
+	if stub.calls != 2 {
+		t.Errorf("provider was called %d times, want 2", stub.calls)
+	}
+}
+
+func TestCachedMetricsPropagatesError(t *testing.T) {
+	stub := &stubMetricsProvider{err: errors.New("provider failed")}
+	c := newCachedMetrics(stub, time.Minute)
+
+	if _, err := c.GetMetrics("/vol"); err == nil {
+		t.Fatalf("expected the underlying provider's error to propagate, got none")
+	}
+}